@@ -1,12 +1,17 @@
 package hostess
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 const default_osx = `
@@ -36,42 +41,246 @@ ff02::2 ip6-allrouters
 ff02::3 ip6-allhosts
 `
 
+// lineKind classifies a HostsLine so Format knows how to render it.
+type lineKind int
+
+const (
+	blankLine lineKind = iota
+	commentLine
+	entryLine
+	disabledEntryLine
+)
+
+// HostsLine is one line of a hosts file, in file order. Blank and comment
+// lines carry no Hosts/IP and are round-tripped verbatim via Raw; entry and
+// disabledEntry lines carry the parsed IP/Hosts/Comment alongside the Raw
+// text they came from so Format can pass them through unchanged unless
+// they've been mutated since Load. Lines created by Add (rather than
+// Parse) have no Raw text and are always considered dirty.
+type HostsLine struct {
+	Raw     string
+	IP      string
+	Hosts   []string
+	Comment string
+	Enabled bool
+	Kind    lineKind
+
+	dirty bool
+}
+
 // Hostfile represents /etc/hosts (or a similar file, depending on OS), and
 // includes a list of Hostnames. Hostfile includes
 type Hostfile struct {
-	Path  string
-	Hosts map[string]*Hostname
-	data  string
+	Path string
+	// BackupPath is where Save() stashes a copy of the existing file before
+	// replacing it. Defaults to Path + ".bak" when empty.
+	BackupPath string
+	// ValidationMode controls how strictly Add checks hostnames and IPs.
+	// Defaults to Legacy so existing callers keep today's behavior.
+	ValidationMode ValidationMode
+	Hosts          map[string]*Hostname
+	data           string
+
+	// mu guards Hosts as well as lines/hostsIdx/ipsIdx below, so Add,
+	// Delete, Enable, Disable and the read-only lookups (Contains,
+	// ListDomains, LookupHost, LookupAddr, ...) are safe to call
+	// concurrently, e.g. from a HostfileSet's background refresher and a
+	// ServeDNS handler at the same time.
+	mu sync.RWMutex
+	// lines holds the file in order (set by Parse) plus any lines Add has
+	// synthesized for entries that didn't come from the file. hostsIdx and
+	// ipsIdx index into it so ListDomainsByIp/Format are O(1)/O(k) instead
+	// of a full scan of Hosts. They're kept in sync incrementally by
+	// Add/Delete/Enable/Disable, and rebuilt wholesale by rebuildIndex. A
+	// line whose Hosts slice has been emptied out is left in place as a
+	// tombstone rather than compacted, so indices never need to shift.
+	lines    []HostsLine
+	hostsIdx map[string]int   // domain -> index into lines
+	ipsIdx   map[string][]int // ip -> indices into lines
 }
 
 // NewHostFile creates a new Hostfile object from the specified file.
 func NewHostfile(path string) *Hostfile {
-	return &Hostfile{path, make(map[string]*Hostname), ""}
+	return &Hostfile{
+		Path:     path,
+		Hosts:    make(map[string]*Hostname),
+		hostsIdx: make(map[string]int),
+		ipsIdx:   make(map[string][]int),
+	}
 }
 
+// lineIndexFor returns the index into h.lines holding the (possibly empty,
+// tombstoned) line for ip/enabled, synthesizing a new dirty one if none
+// exists yet.
+func (h *Hostfile) lineIndexFor(ip string, enabled bool) int {
+	for _, idx := range h.ipsIdx[ip] {
+		if h.lines[idx].Enabled == enabled {
+			return idx
+		}
+	}
+	kind := entryLine
+	if !enabled {
+		kind = disabledEntryLine
+	}
+	h.lines = append(h.lines, HostsLine{IP: ip, Enabled: enabled, Kind: kind, dirty: true})
+	idx := len(h.lines) - 1
+	h.ipsIdx[ip] = append(h.ipsIdx[ip], idx)
+	return idx
+}
+
+// indexAdd records host in the line for its Ip/Enabled pair, marking that
+// line dirty so Format regenerates it instead of passing Raw through.
+func (h *Hostfile) indexAdd(host Hostname) {
+	idx := h.lineIndexFor(host.Ip, host.Enabled)
+	h.lines[idx].Hosts = append(h.lines[idx].Hosts, host.Domain)
+	h.lines[idx].dirty = true
+	h.hostsIdx[host.Domain] = idx
+}
+
+// indexRemove drops domain from whichever line it's indexed under, marking
+// that line dirty.
+func (h *Hostfile) indexRemove(domain string) {
+	idx, ok := h.hostsIdx[domain]
+	if !ok {
+		return
+	}
+	hosts := h.lines[idx].Hosts
+	for i, d := range hosts {
+		if d == domain {
+			h.lines[idx].Hosts = append(hosts[:i], hosts[i+1:]...)
+			h.lines[idx].dirty = true
+			break
+		}
+	}
+	delete(h.hostsIdx, domain)
+}
+
+// rebuildIndex throws away lines/hostsIdx/ipsIdx and reconstructs them from
+// the current contents of Hosts. Hosts is a map, so entries are visited in
+// sorted (Ip, Domain) order rather than map iteration order -- otherwise
+// lines, and therefore Format's output, would come out in a different order
+// on every call for byte-identical input.
+func (h *Hostfile) rebuildIndex() {
+	h.lines = nil
+	h.hostsIdx = make(map[string]int)
+	h.ipsIdx = make(map[string][]int)
+
+	hostnames := make([]*Hostname, 0, len(h.Hosts))
+	for _, hostname := range h.Hosts {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Slice(hostnames, func(i, j int) bool {
+		if hostnames[i].Ip != hostnames[j].Ip {
+			return hostnames[i].Ip < hostnames[j].Ip
+		}
+		return hostnames[i].Domain < hostnames[j].Domain
+	})
+
+	for _, hostname := range hostnames {
+		h.indexAdd(*hostname)
+	}
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
 func (h *Hostfile) Load() string {
 	data, err := ioutil.ReadFile(h.Path)
 	if err != nil {
 		fmt.Println("Can't read ", h.Path)
 		os.Exit(1)
 	}
-	h.data = string(data)
+	data = bytes.TrimPrefix(data, utf8BOM)
+	h.data = strings.Replace(string(data), "\r\n", "\n", -1)
 	return h.data
 }
 
+// Parse rebuilds Hosts and the line index from h.data, one HostsLine per
+// line of input so Format can round-trip comments, blank lines and
+// ordering unchanged.
 func (h *Hostfile) Parse() []error {
 	var errs []error
-	for _, v := range strings.Split(h.data, "\n") {
-		for _, hostname := range ParseLine(v) {
-			err := h.Add(hostname)
-			if err != nil {
-				errs = append(errs, err)
+
+	h.Hosts = make(map[string]*Hostname)
+	h.lines = nil
+	h.hostsIdx = make(map[string]int)
+	h.ipsIdx = make(map[string][]int)
+
+	for i, raw := range strings.Split(h.data, "\n") {
+		line := parseHostsLine(raw)
+		idx := len(h.lines)
+		h.lines = append(h.lines, line)
+
+		if line.Kind != entryLine && line.Kind != disabledEntryLine {
+			continue
+		}
+		h.ipsIdx[line.IP] = append(h.ipsIdx[line.IP], idx)
+
+		for _, domain := range line.Hosts {
+			hostname := Hostname{domain, line.IP, line.Enabled}
+			if err := h.addAt(hostname, idx); err != nil {
+				errs = append(errs, &ParseError{Line: i + 1, Raw: raw, Reason: err})
 			}
 		}
 	}
+
 	return errs
 }
 
+// parseHostsLine classifies a single raw line of a hosts file and, for
+// entry/disabledEntry lines, extracts its IP, hostnames and trailing
+// comment. It leans on ParseLine for the actual IP/hostname parsing so the
+// two never disagree about what counts as a valid entry.
+func parseHostsLine(raw string) HostsLine {
+	if TrimWS(raw) == "" {
+		return HostsLine{Raw: raw, Kind: blankLine}
+	}
+
+	hostnames := ParseLine(raw)
+	if len(hostnames) == 0 {
+		return HostsLine{Raw: raw, Kind: commentLine, Comment: strings.TrimPrefix(TrimWS(raw), "#")}
+	}
+
+	domains := make([]string, len(hostnames))
+	for i, hostname := range hostnames {
+		domains[i] = hostname.Domain
+	}
+
+	enabled := hostnames[0].Enabled
+	kind := entryLine
+	if !enabled {
+		kind = disabledEntryLine
+	}
+
+	return HostsLine{
+		Raw:     raw,
+		IP:      hostnames[0].Ip,
+		Hosts:   domains,
+		Comment: trailingComment(raw, enabled),
+		Enabled: enabled,
+		Kind:    kind,
+	}
+}
+
+// trailingComment returns the comment following the hostname list on an
+// entry line, e.g. "1.2.3.4 foo # staging" -> "staging". For a disabled
+// entry the leading '#' that disables the whole line is skipped first.
+func trailingComment(raw string, enabled bool) string {
+	body := raw
+	if !enabled {
+		idx := strings.Index(body, "#")
+		if idx < 0 {
+			return ""
+		}
+		body = body[idx+1:]
+	}
+
+	idx := strings.Index(body, "#")
+	if idx < 0 {
+		return ""
+	}
+	return TrimWS(body[idx+1:])
+}
+
 func LoadHostFile() (*Hostfile, []error) {
 	hostfile := NewHostfile(GetHostsPath())
 	hostfile.Load()
@@ -122,17 +331,6 @@ func ParseLine(line string) []Hostname {
 	return hostnames
 }
 
-func getSortedMapKeys(m map[string][]string) []string {
-	keys := make([]string, len(m))
-	i := 0
-	for k := range m {
-		keys[i] = k
-		i += 1
-	}
-	sort.Strings(keys)
-	return keys
-}
-
 // MoveToFront looks for string in a slice of strings and if it finds it, moves
 // it to the front of the slice.
 // Note: this could probably be made faster using pointers to switch the values
@@ -149,11 +347,12 @@ func MoveToFront(list []string, search string) []string {
 // ListDomainsByIp will look through Hostfile to find domains that match the
 // specified Ip and return them in a sorted slice.
 func (h *Hostfile) ListDomainsByIp(ip string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
 	var names []string
-	for _, v := range h.Hosts {
-		if v.Ip == ip {
-			names = append(names, v.Domain)
-		}
+	for _, idx := range h.ipsIdx[ip] {
+		names = append(names, h.lines[idx].Hosts...)
 	}
 	sort.Strings(names)
 
@@ -167,6 +366,9 @@ func (h *Hostfile) ListDomainsByIp(ip string) []string {
 
 // ListDomains will return a list of domains in alphabetical order.
 func (h *Hostfile) ListDomains() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
 	var names []string
 	for _, v := range h.Hosts {
 		names = append(names, v.Domain)
@@ -175,142 +377,299 @@ func (h *Hostfile) ListDomains() []string {
 	return names
 }
 
-// Format takes the current list of Hostnames in this Hostfile and turns it
-// into a string suitable for use as an /etc/hosts file.
-// Sorting uses the following logic:
-// 1. List is sorted by IP address
-// 2. Commented items are left in place
-// 3. 127.* appears at the top of the list (so boot resolvers don't break)
-// 4. When present, localhost will always appear first in the domain list
+// Format turns the current Hostfile back into text suitable for use as a
+// hosts file. Lines that came from Load/Parse and haven't been touched
+// since are emitted verbatim, comments and blank lines included, so editing
+// a few entries doesn't reshuffle or strip the rest of the file. Lines that
+// have been mutated (or added via Add, which has no original line to
+// preserve) are regenerated, with domains sorted and localhost pinned
+// first on 127.0.0.1.
 func (h *Hostfile) Format() string {
-	// localhost := "127.0.0.1 localhost"
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 
-	localhosts := make(map[string][]string)
-	ips := make(map[string][]string)
-
-	// Map domains and IPs into slices of domains keyd by IP
-	// 127.0.0.1 = [localhost, blah, blah2]
-	// 2.2.2.3 = [domain1, domain2]
-	for _, hostname := range h.Hosts {
-		if hostname.Ip[0:4] == "127." {
-			localhosts[hostname.Ip] = append(localhosts[hostname.Ip], hostname.Domain)
-		} else {
-			ips[hostname.Ip] = append(ips[hostname.Ip], hostname.Domain)
+	var out []string
+	for _, line := range h.lines {
+		if line.Raw != "" && !line.dirty {
+			out = append(out, line.Raw)
+			continue
+		}
+		if rendered, ok := renderHostsLine(line); ok {
+			out = append(out, rendered)
 		}
 	}
 
-	localhosts_keys := getSortedMapKeys(localhosts)
-	ips_keys := getSortedMapKeys(ips)
-	var out []string
+	return strings.Join(out, "\n")
+}
 
-	for _, ip := range localhosts_keys {
-		enabled := ip
-		enabled_b := false
-		disabled := "# " + ip
-		disabled_b := false
-		for _, domain := range h.ListDomainsByIp(ip) {
-			hostname := *h.Hosts[domain]
-			if hostname.Ip == ip {
-				if hostname.Enabled {
-					enabled += " " + hostname.Domain
-					enabled_b = true
-				} else {
-					disabled += " " + hostname.Domain
-					disabled_b = true
-				}
-			}
+// renderHostsLine regenerates the text for a mutated or synthesized line.
+// It returns ok=false for a line whose last domain has been deleted, so
+// Format can drop it instead of emitting a bare IP.
+func renderHostsLine(line HostsLine) (string, bool) {
+	switch line.Kind {
+	case blankLine:
+		return "", true
+	case commentLine:
+		return line.Raw, true
+	case entryLine, disabledEntryLine:
+		if len(line.Hosts) == 0 {
+			return "", false
 		}
-		if enabled_b {
-			out = append(out, enabled)
-		}
-		if disabled_b {
-			out = append(out, disabled)
+
+		domains := append([]string(nil), line.Hosts...)
+		sort.Strings(domains)
+		if line.IP == "127.0.0.1" {
+			domains = MoveToFront(domains, "localhost")
 		}
-	}
 
-	for _, ip := range ips_keys {
-		enabled := ip
-		enabled_b := false
-		disabled := "# " + ip
-		disabled_b := false
-		for _, domain := range h.ListDomainsByIp(ip) {
-			hostname := *h.Hosts[domain]
-			if hostname.Ip == ip {
-				if hostname.Enabled {
-					enabled += " " + hostname.Domain
-					enabled_b = true
-				} else {
-					disabled += " " + hostname.Domain
-					disabled_b = true
-				}
-			}
+		text := line.IP
+		if !line.Enabled {
+			text = "# " + text
 		}
-		if enabled_b {
-			out = append(out, enabled)
+		for _, domain := range domains {
+			text += " " + domain
 		}
-		if disabled_b {
-			out = append(out, disabled)
+		if line.Comment != "" {
+			text += " # " + line.Comment
 		}
+		return text, true
+	default:
+		return "", false
 	}
-
-	return strings.Join(out, "\n")
 }
 
-func (h *Hostfile) Save() error {
-	// h.Format(h.Path)
+// IsWritable probes h.Path by opening it for writing, returning an error
+// describing why it's not writable (permissions, missing parent dir, etc) so
+// callers can surface a clear message before attempting to mutate it.
+func (h *Hostfile) IsWritable() error {
+	f, err := os.OpenFile(h.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %s", h.Path, err)
+	}
+	f.Close()
 	return nil
 }
 
-func (h *Hostfile) Contains(b Hostname) bool {
-	for _, a := range h.Hosts {
-		if a.Equals(b) {
-			return true
+// backupPath returns the path Save() should copy the existing file to before
+// replacing it.
+func (h *Hostfile) backupPath() string {
+	if h.BackupPath != "" {
+		return h.BackupPath
+	}
+	return h.Path + ".bak"
+}
+
+// backup copies the existing file at h.Path to backupPath() so a bad Save()
+// can be recovered from. It's a no-op if h.Path doesn't exist yet.
+func (h *Hostfile) backup() error {
+	in, err := os.Open(h.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(h.backupPath())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// Save renders Format() and atomically replaces the file at h.Path. It backs
+// up the existing file first, writes the new contents to a temp file in the
+// same directory (so the final rename stays on one filesystem), fsyncs it,
+// matches the mode of the file it's replacing, then renames it into place.
+// Matching owner/group is best-effort: a caller with write permission on
+// h.Path but not matching ownership (a root-owned, world-writable /etc/hosts
+// in a container, say) can't Chown even though the Rename that follows would
+// have succeeded, so a failed Chown is ignored rather than aborting Save.
+func (h *Hostfile) Save() error {
+	if err := h.backup(); err != nil {
+		return fmt.Errorf("unable to back up %s: %s", h.Path, err)
+	}
+
+	mode := os.FileMode(0644)
+	uid, gid := -1, -1
+	if info, err := os.Stat(h.Path); err == nil {
+		mode = info.Mode()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(stat.Uid), int(stat.Gid)
 		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	dir := filepath.Dir(h.Path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(h.Path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temp file in %s: %s", dir, err)
 	}
-	return false
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.WriteString(h.Format()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		return err
+	}
+	if uid != -1 {
+		// Best-effort: ignore the error. A caller who can write h.Path but
+		// doesn't own it (or isn't privileged) will never be able to Chown,
+		// and that shouldn't block an otherwise-successful Save.
+		os.Chown(tmpPath, uid, gid)
+	}
+
+	return os.Rename(tmpPath, h.Path)
+}
+
+func (h *Hostfile) Contains(b Hostname) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	existing, found := h.Hosts[b.Domain]
+	return found && existing.Equals(b)
 }
 
 func (h *Hostfile) ContainsDomain(search string) bool {
-	for _, hostname := range h.Hosts {
-		if hostname.Domain == search {
-			return true
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	_, found := h.Hosts[search]
+	return found
+}
+
+// checkAdd validates host and checks it against the existing Hosts map,
+// shared by Add (which indexes a new line for host) and addAt (which
+// indexes it against a line Parse already built). reject is true when err
+// should stop the caller from registering host at all -- a duplicate,
+// a conflict, or a Strict validation failure. A non-nil err with
+// reject=false is a Lenient validation warning: the caller should still
+// register host. Callers must hold h.mu for writing.
+func (h *Hostfile) checkAdd(host Hostname) (reject bool, err error) {
+	if h.ValidationMode != Legacy {
+		if e := validateHostname(host.Domain); e != nil {
+			err = e
+		} else if e := validateIP(host.Ip); e != nil {
+			err = e
 		}
+		if err != nil && h.ValidationMode == Strict {
+			return true, err
+		}
+	}
+
+	if existing, found := h.Hosts[host.Domain]; found {
+		if existing.Ip == host.Ip {
+			return true, errors.New(fmt.Sprintf("Duplicate hostname entry for %s -> %s",
+				host.Domain, host.Ip))
+		}
+		return true, errors.New(fmt.Sprintf("Conflicting hostname entries for %s -> %s and -> %s",
+			host.Domain, host.Ip, existing.Ip))
 	}
-	return false
+
+	return false, err
 }
 
 func (h *Hostfile) Add(host Hostname) error {
-	host_f, found := h.Hosts[host.Domain]
-	if found {
-		if host_f.Ip == host.Ip {
-			return errors.New(fmt.Sprintf("Duplicate hostname entry for %s -> %s",
-				host.Domain, host.Ip))
-		} else {
-			return errors.New(fmt.Sprintf("Conflicting hostname entries for %s -> %s and -> %s",
-				host.Domain, host.Ip, host_f.Ip))
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	reject, err := h.checkAdd(host)
+	if reject {
+		return err
+	}
+
+	h.Hosts[host.Domain] = &host
+	h.indexAdd(host)
+
+	return err
+}
+
+// addAt is like Add, but attaches host to the line Parse already built for
+// it at idx instead of synthesizing a new one.
+func (h *Hostfile) addAt(host Hostname, idx int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	reject, err := h.checkAdd(host)
+	if reject {
+		// host isn't going into Hosts/hostsIdx, so it can't stay on the
+		// line either -- otherwise Format would keep emitting it verbatim
+		// forever even though it's invisible everywhere else.
+		h.pruneLineHost(idx, host.Domain)
+		return err
+	}
+
+	h.Hosts[host.Domain] = &host
+	h.hostsIdx[host.Domain] = idx
+
+	return err
+}
+
+// pruneLineHost removes domain from h.lines[idx].Hosts and marks the line
+// dirty, so Format regenerates it instead of passing Raw through. Callers
+// must hold h.mu for writing.
+func (h *Hostfile) pruneLineHost(idx int, domain string) {
+	hosts := h.lines[idx].Hosts
+	for i, d := range hosts {
+		if d == domain {
+			h.lines[idx].Hosts = append(hosts[:i], hosts[i+1:]...)
+			h.lines[idx].dirty = true
+			return
 		}
-	} else {
-		h.Hosts[host.Domain] = &host
 	}
-	return nil
 }
 
 func (h *Hostfile) Delete(domain string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	delete(h.Hosts, domain)
+	h.indexRemove(domain)
 }
 
 func (h *Hostfile) Enable(domain string) {
-	_, ok := h.Hosts[domain]
-	if ok {
-		h.Hosts[domain].Enabled = true
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hostname, ok := h.Hosts[domain]
+	if !ok || hostname.Enabled {
+		return
 	}
+	hostname.Enabled = true
+
+	h.indexRemove(domain)
+	h.indexAdd(*hostname)
 }
 
 func (h *Hostfile) Disable(domain string) {
-	_, ok := h.Hosts[domain]
-	if ok {
-		h.Hosts[domain].Enabled = false
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hostname, ok := h.Hosts[domain]
+	if !ok || !hostname.Enabled {
+		return
 	}
+	hostname.Enabled = false
+
+	h.indexRemove(domain)
+	h.indexAdd(*hostname)
 }
 
 func GetHostsPath() string {
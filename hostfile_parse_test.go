@@ -0,0 +1,105 @@
+package hostess
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFormatRoundTripPreservesCommentsAndBlankLines(t *testing.T) {
+	data := "# a comment\n\n127.0.0.1 localhost\n192.168.1.1 foo.example.com\n"
+
+	h := NewHostfile("")
+	h.data = data
+	if errs := h.Parse(); len(errs) != 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	if got := h.Format(); got != data {
+		t.Errorf("Format() = %q, want %q (untouched lines must round-trip verbatim)", got, data)
+	}
+}
+
+func TestFormatOnlyRewritesMutatedLines(t *testing.T) {
+	data := "# keep me\n127.0.0.1 localhost\n10.0.0.1 foo\n"
+
+	h := NewHostfile("")
+	h.data = data
+	if errs := h.Parse(); len(errs) != 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	h.Disable("foo")
+
+	got := h.Format()
+	want := "# keep me\n127.0.0.1 localhost\n\n# 10.0.0.1 foo"
+	if got != want {
+		t.Errorf("Format() = %q, want %q", got, want)
+	}
+	if !strings.Contains(got, "# keep me") {
+		t.Errorf("Format() dropped the untouched comment line: %q", got)
+	}
+}
+
+func TestLoadStripsBOMAndNormalizesCRLF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	raw := append(append([]byte{}, utf8BOM...), []byte("127.0.0.1 localhost\r\n10.0.0.1 foo\r\n")...)
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHostfile(path)
+	data := h.Load()
+
+	if strings.HasPrefix(data, "\xef\xbb\xbf") {
+		t.Error("Load() did not strip the UTF-8 BOM")
+	}
+	if strings.Contains(data, "\r") {
+		t.Error("Load() did not normalize CRLF to LF")
+	}
+}
+
+// TestParseDropsDuplicateDomainFromSource covers the Parse/addAt/Format
+// interaction: a domain that addAt rejects (here, a conflicting duplicate)
+// must be pruned from its line's Hosts and the line marked dirty, or Format
+// would keep emitting the rejected entry verbatim forever even though it's
+// invisible to Hosts/ListDomains/LookupHost.
+func TestParseDropsDuplicateDomainFromSource(t *testing.T) {
+	data := "1.2.3.4 foo\n5.6.7.8 foo\n"
+
+	h := NewHostfile("")
+	h.data = data
+	errs := h.Parse()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 conflict error, got %d: %v", len(errs), errs)
+	}
+
+	want := "1.2.3.4 foo\n"
+	if got := h.Format(); got != want {
+		t.Errorf("Format() = %q, want %q (conflicting duplicate should be dropped)", got, want)
+	}
+}
+
+func TestParseStrictValidationDropsInvalidDomainFromSource(t *testing.T) {
+	data := "1.2.3.4 not_a_valid_hostname!!\n"
+
+	h := NewHostfile("")
+	h.ValidationMode = Strict
+	h.data = data
+	errs := h.Parse()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 validation error, got %d: %v", len(errs), errs)
+	}
+
+	if got := h.Format(); got != "" {
+		t.Errorf("Format() = %q, want empty (invalid entry should be dropped, not round-tripped)", got)
+	}
+}
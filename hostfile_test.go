@@ -0,0 +1,102 @@
+package hostess
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveWritesFormattedContentsAndBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1 old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHostfile(path)
+	h.Load()
+	if errs := h.Parse(); len(errs) != 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+	if err := h.Add(Hostname{"example.com", "1.2.3.4", true}); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+
+	if err := h.Save(); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "127.0.0.1 old\n\n1.2.3.4 example.com"
+	if string(got) != want {
+		t.Errorf("Save wrote %q, want %q", got, want)
+	}
+
+	backup, err := ioutil.ReadFile(path + ".bak")
+	if err != nil {
+		t.Fatalf("expected a backup file: %s", err)
+	}
+	if string(backup) != "127.0.0.1 old\n" {
+		t.Errorf("backup contents = %q, want the pre-Save file contents", backup)
+	}
+}
+
+func TestSavePreservesExistingMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1 localhost\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHostfile(path)
+	h.Load()
+	h.Parse()
+	if err := h.Save(); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Save changed mode to %o, want 0640", info.Mode().Perm())
+	}
+}
+
+func TestIsWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hostess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHostfile(path)
+	if err := h.IsWritable(); err != nil {
+		t.Errorf("IsWritable on a writable file returned an error: %s", err)
+	}
+
+	missing := NewHostfile(filepath.Join(dir, "does-not-exist"))
+	if err := missing.IsWritable(); err == nil {
+		t.Error("IsWritable on a missing file should return an error")
+	}
+}
@@ -0,0 +1,57 @@
+package hostess
+
+import (
+	"fmt"
+	"net"
+)
+
+// LookupHost returns the IP addresses of enabled entries for the given
+// hostname, mirroring the semantics of net.Resolver.LookupHost but served
+// entirely from this Hostfile rather than the system resolver.
+func (h *Hostfile) LookupHost(name string) ([]net.IP, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	hostname, ok := h.Hosts[name]
+	if !ok || !hostname.Enabled {
+		return nil, fmt.Errorf("lookup %s: no such host", name)
+	}
+
+	ip := net.ParseIP(hostname.Ip)
+	if ip == nil {
+		return nil, fmt.Errorf("lookup %s: invalid address %s", name, hostname.Ip)
+	}
+
+	return []net.IP{ip}, nil
+}
+
+// LookupAddr returns the hostnames of enabled entries pointing at ip,
+// mirroring the semantics of net.Resolver.LookupAddr. The first name in the
+// returned slice is the canonical name for ip, with the rest being aliases,
+// mirroring glibc's hosts module and net.lookupStaticHost: the canonical
+// name is whichever hostname was written first on its line in the file,
+// not an alphabetical pick. This walks h.lines in file order rather than
+// ListDomainsByIp, which sorts alphabetically and would scramble that.
+func (h *Hostfile) LookupAddr(ip string) ([]string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("lookup addr: invalid address %s", ip)
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var names []string
+	for _, idx := range h.ipsIdx[ip] {
+		line := h.lines[idx]
+		if line.Enabled {
+			names = append(names, line.Hosts...)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("lookup addr: no such host for %s", ip)
+	}
+
+	return names, nil
+}
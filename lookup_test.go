@@ -0,0 +1,75 @@
+package hostess
+
+import "testing"
+
+func TestLookupHost(t *testing.T) {
+	h := NewHostfile("")
+	h.data = "127.0.0.1 localhost\n1.2.3.4 foo\n# 5.6.7.8 disabled\n"
+	if errs := h.Parse(); len(errs) != 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	ips, err := h.LookupHost("foo")
+	if err != nil {
+		t.Fatalf("LookupHost(foo): %s", err)
+	}
+	if len(ips) != 1 || ips[0].String() != "1.2.3.4" {
+		t.Errorf("LookupHost(foo) = %v, want [1.2.3.4]", ips)
+	}
+
+	if _, err := h.LookupHost("disabled"); err == nil {
+		t.Error("LookupHost(disabled) should fail for a disabled entry")
+	}
+
+	if _, err := h.LookupHost("missing"); err == nil {
+		t.Error("LookupHost(missing) should fail for an unknown host")
+	}
+}
+
+// TestLookupAddrCanonicalNameIsFileOrderNotAlphabetical covers the fix for
+// LookupAddr: the canonical name is whichever hostname was written first on
+// its line in the file, not whichever sorts first alphabetically.
+func TestLookupAddrCanonicalNameIsFileOrderNotAlphabetical(t *testing.T) {
+	h := NewHostfile("")
+	h.data = "10.0.0.1 zzz aaa\n"
+	if errs := h.Parse(); len(errs) != 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	names, err := h.LookupAddr("10.0.0.1")
+	if err != nil {
+		t.Fatalf("LookupAddr: %s", err)
+	}
+	want := []string{"zzz", "aaa"}
+	if len(names) != len(want) || names[0] != want[0] || names[1] != want[1] {
+		t.Errorf("LookupAddr(10.0.0.1) = %v, want %v (zzz written first on the line is canonical)", names, want)
+	}
+}
+
+func TestLookupAddrSkipsDisabledEntries(t *testing.T) {
+	h := NewHostfile("")
+	h.data = "10.0.0.1 foo\n# 10.0.0.1 bar\n"
+	if errs := h.Parse(); len(errs) != 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	names, err := h.LookupAddr("10.0.0.1")
+	if err != nil {
+		t.Fatalf("LookupAddr: %s", err)
+	}
+	if len(names) != 1 || names[0] != "foo" {
+		t.Errorf("LookupAddr(10.0.0.1) = %v, want [foo] (disabled entry must be excluded)", names)
+	}
+}
+
+func TestLookupAddrNoSuchHost(t *testing.T) {
+	h := NewHostfile("")
+	h.data = "10.0.0.1 foo\n"
+	if errs := h.Parse(); len(errs) != 0 {
+		t.Fatalf("unexpected parse errors: %v", errs)
+	}
+
+	if _, err := h.LookupAddr("10.0.0.2"); err == nil {
+		t.Error("LookupAddr should fail for an IP with no entries")
+	}
+}
@@ -0,0 +1,100 @@
+//go:build dns
+// +build dns
+
+package hostess
+
+// This file pulls in github.com/miekg/dns and is only compiled when built
+// with `-tags dns`, so the core package stays free of that dependency for
+// consumers who just want the file-editing API.
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ServeDNS answers an A/AAAA/PTR query straight from this Hostfile, letting
+// hostess plug directly into miekg/dns as a local resolver or test server.
+func (h *Hostfile) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+
+	for _, q := range r.Question {
+		switch q.Qtype {
+		case dns.TypeA, dns.TypeAAAA:
+			name := strings.TrimSuffix(q.Name, ".")
+			ips, err := h.LookupHost(name)
+			if err != nil {
+				continue
+			}
+			for _, ip := range ips {
+				if v4 := ip.To4(); v4 != nil && q.Qtype == dns.TypeA {
+					msg.Answer = append(msg.Answer, &dns.A{
+						Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+						A:   v4,
+					})
+				} else if v4 == nil && q.Qtype == dns.TypeAAAA {
+					msg.Answer = append(msg.Answer, &dns.AAAA{
+						Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+						AAAA: ip,
+					})
+				}
+			}
+		case dns.TypePTR:
+			ip := arpaToIP(q.Name)
+			if ip == "" {
+				continue
+			}
+			names, err := h.LookupAddr(ip)
+			if err != nil {
+				continue
+			}
+			for _, name := range names {
+				msg.Answer = append(msg.Answer, &dns.PTR{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
+					Ptr: dns.Fqdn(name),
+				})
+			}
+		}
+	}
+
+	w.WriteMsg(msg)
+}
+
+// arpaToIP converts a reverse-lookup query name like
+// "1.0.0.127.in-addr.arpa." back into "127.0.0.1". It returns "" if name
+// isn't a recognized in-addr.arpa/ip6.arpa name.
+func arpaToIP(name string) string {
+	if strings.HasSuffix(name, ".in-addr.arpa.") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != 4 {
+			return ""
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		ip := net.ParseIP(strings.Join(labels, "."))
+		if ip == nil {
+			return ""
+		}
+		return ip.String()
+	}
+
+	if strings.HasSuffix(name, ".ip6.arpa.") {
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(nibbles) != 32 {
+			return ""
+		}
+		var groups []string
+		for i := len(nibbles) - 4; i >= 0; i -= 4 {
+			groups = append(groups, nibbles[i+3]+nibbles[i+2]+nibbles[i+1]+nibbles[i])
+		}
+		if ip := net.ParseIP(strings.Join(groups, ":")); ip != nil {
+			return ip.String()
+		}
+	}
+
+	return ""
+}
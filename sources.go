@@ -0,0 +1,219 @@
+package hostess
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Source is a single input to a HostfileSet -- a local file or a remote URL
+// serving hosts-format text (e.g. a StevenBlack-style blocklist).
+type Source interface {
+	// Fetch opens the source for reading. The caller is responsible for
+	// closing the returned ReadCloser.
+	Fetch(ctx context.Context) (io.ReadCloser, error)
+	// Name identifies the source, e.g. for ListBySource/DisableSource.
+	Name() string
+}
+
+// FileSource reads hosts-format data from a local file.
+type FileSource struct {
+	Path string
+}
+
+func (s FileSource) Fetch(ctx context.Context) (io.ReadCloser, error) {
+	return os.Open(s.Path)
+}
+
+func (s FileSource) Name() string {
+	return s.Path
+}
+
+// HTTPSource downloads hosts-format data from an HTTP(S) URL.
+type HTTPSource struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s HTTPSource) Fetch(ctx context.Context) (io.ReadCloser, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetch %s: unexpected status %s", s.URL, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+func (s HTTPSource) Name() string {
+	return s.URL
+}
+
+// ConflictPolicy controls what HostfileSet.Load does when two sources
+// disagree about a domain's IP.
+type ConflictPolicy int
+
+const (
+	// FirstWins keeps whichever entry was merged in first and ignores later
+	// conflicting entries.
+	FirstWins ConflictPolicy = iota
+	// LastWins overwrites earlier entries with later conflicting ones.
+	LastWins
+	// ErrorOnConflict surfaces conflicts as errors rather than merging.
+	ErrorOnConflict
+)
+
+// HostfileSet composes a Hostfile out of multiple Sources -- local files
+// plus remote hosts-format blocklists -- and merges them according to
+// Policy. It's safe for concurrent use: the merged Hostfile is only ever
+// reachable through Current(), which reads it under mu, so a Load() racing
+// with a ServeDNS-style reader never hands out the pointer unsynchronized.
+type HostfileSet struct {
+	Sources []Source
+	Policy  ConflictPolicy
+
+	mu       sync.RWMutex
+	hostfile *Hostfile
+	// origin tracks which Source each domain was merged in from. Hostname
+	// itself has no room for this (it's shared with the rest of the package
+	// and predates HostfileSet), so origin is tracked here as a side map
+	// instead of tagging the Hostname directly.
+	origin map[string]string // domain -> source name
+}
+
+// NewHostfileSet creates a HostfileSet backed by a fresh, empty Hostfile.
+func NewHostfileSet(policy ConflictPolicy, sources ...Source) *HostfileSet {
+	return &HostfileSet{
+		hostfile: NewHostfile(""),
+		Sources:  sources,
+		Policy:   policy,
+		origin:   make(map[string]string),
+	}
+}
+
+// Current returns the Hostfile most recently merged in by Load. Callers
+// should use the returned pointer instead of holding onto one across a
+// Load(), since each successful Load() swaps in a brand new Hostfile rather
+// than mutating the old one in place.
+func (set *HostfileSet) Current() *Hostfile {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	return set.hostfile
+}
+
+// Load fetches every Source, parses it, and merges the results into a fresh
+// Hostfile according to Policy, atomically swapping it in on success.
+func (set *HostfileSet) Load(ctx context.Context) error {
+	merged := NewHostfile("")
+	origin := make(map[string]string)
+
+	for _, src := range set.Sources {
+		rc, err := src.Fetch(ctx)
+		if err != nil {
+			return fmt.Errorf("fetch %s: %s", src.Name(), err)
+		}
+
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("read %s: %s", src.Name(), err)
+		}
+
+		temp := NewHostfile("")
+		temp.data = string(data)
+		temp.Parse()
+
+		for domain, hostname := range temp.Hosts {
+			existing, found := merged.Hosts[domain]
+			if found && existing.Ip != hostname.Ip {
+				switch set.Policy {
+				case FirstWins:
+					continue
+				case LastWins:
+					// fall through and overwrite below
+				case ErrorOnConflict:
+					return fmt.Errorf("conflicting hostname entries for %s -> %s (from %s) and -> %s (from %s)",
+						domain, hostname.Ip, src.Name(), existing.Ip, origin[domain])
+				}
+			}
+			h := *hostname
+			merged.Hosts[domain] = &h
+			origin[domain] = src.Name()
+		}
+	}
+
+	merged.rebuildIndex()
+
+	set.mu.Lock()
+	set.hostfile = merged
+	set.origin = origin
+	set.mu.Unlock()
+
+	return nil
+}
+
+// ListBySource returns the domains currently merged in from the named
+// source.
+func (set *HostfileSet) ListBySource(name string) []string {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	var domains []string
+	for domain, src := range set.origin {
+		if src == name {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// DisableSource disables every entry that was merged in from the named
+// source, leaving entries from other sources untouched.
+func (set *HostfileSet) DisableSource(name string) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	for domain, src := range set.origin {
+		if src == name {
+			set.hostfile.Disable(domain)
+		}
+	}
+}
+
+// StartPeriodicRefresh re-runs Load on the given interval until ctx is
+// cancelled, so remote sources stay up to date. Load errors are swallowed so
+// a single bad refresh (e.g. the blocklist server is briefly down) doesn't
+// take down the refresher; the previous merged Hostfile is left in place.
+func (set *HostfileSet) StartPeriodicRefresh(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				set.Load(ctx)
+			}
+		}
+	}()
+}
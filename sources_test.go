@@ -0,0 +1,91 @@
+package hostess
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+type stringSource struct {
+	name string
+	data string
+}
+
+func (s stringSource) Fetch(ctx context.Context) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(s.data)), nil
+}
+
+func (s stringSource) Name() string {
+	return s.name
+}
+
+func TestHostfileSetLoadMergesSources(t *testing.T) {
+	set := NewHostfileSet(FirstWins,
+		stringSource{"a", "1.1.1.1 foo\n"},
+		stringSource{"b", "2.2.2.2 bar\n"},
+	)
+
+	if err := set.Load(context.Background()); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+
+	current := set.Current()
+	if !current.ContainsDomain("foo") || !current.ContainsDomain("bar") {
+		t.Fatalf("expected both foo and bar to be merged in, got domains %v", current.ListDomains())
+	}
+	if got := set.ListBySource("a"); len(got) != 1 || got[0] != "foo" {
+		t.Errorf("ListBySource(a) = %v, want [foo]", got)
+	}
+}
+
+func TestHostfileSetLoadConflictPolicies(t *testing.T) {
+	first := stringSource{"first", "1.1.1.1 foo\n"}
+	second := stringSource{"second", "2.2.2.2 foo\n"}
+
+	firstWins := NewHostfileSet(FirstWins, first, second)
+	if err := firstWins.Load(context.Background()); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if ip := firstWins.Current().Hosts["foo"].Ip; ip != "1.1.1.1" {
+		t.Errorf("FirstWins: foo -> %s, want 1.1.1.1", ip)
+	}
+
+	lastWins := NewHostfileSet(LastWins, first, second)
+	if err := lastWins.Load(context.Background()); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if ip := lastWins.Current().Hosts["foo"].Ip; ip != "2.2.2.2" {
+		t.Errorf("LastWins: foo -> %s, want 2.2.2.2", ip)
+	}
+
+	errorOnConflict := NewHostfileSet(ErrorOnConflict, first, second)
+	if err := errorOnConflict.Load(context.Background()); err == nil {
+		t.Error("ErrorOnConflict: expected Load to return an error for conflicting entries")
+	}
+}
+
+// TestHostfileSetLoadIsDeterministic covers the rebuildIndex ordering fix:
+// repeated Loads of byte-identical source data must produce the same
+// Format() output, not a different line order every time from randomized
+// map iteration.
+func TestHostfileSetLoadIsDeterministic(t *testing.T) {
+	set := NewHostfileSet(FirstWins,
+		stringSource{"a", "1.1.1.1 foo\n2.2.2.2 bar\n3.3.3.3 baz\n"},
+	)
+
+	var formats []string
+	for i := 0; i < 5; i++ {
+		if err := set.Load(context.Background()); err != nil {
+			t.Fatalf("Load: %s", err)
+		}
+		formats = append(formats, set.Current().Format())
+	}
+
+	for i := 1; i < len(formats); i++ {
+		if formats[i] != formats[0] {
+			t.Errorf("Load #%d produced %q, want the same order as Load #0 %q", i, formats[i], formats[0])
+		}
+	}
+}
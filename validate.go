@@ -0,0 +1,85 @@
+package hostess
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ValidationMode controls how strictly Hostfile.Add checks a Hostname
+// before accepting it.
+type ValidationMode int
+
+const (
+	// Legacy only rejects duplicate/conflicting domains, same as before
+	// ValidationMode existed. It's the zero value so existing callers that
+	// never set it see no behavior change.
+	Legacy ValidationMode = iota
+	// Lenient validates the hostname and IP, but keeps the entry and
+	// returns the validation error so callers can warn on it.
+	Lenient
+	// Strict validates the hostname and IP and rejects the entry (without
+	// adding it) if validation fails.
+	Strict
+)
+
+// ParseError describes a line Parse couldn't turn into a valid Hostname,
+// carrying enough context for a CLI to point the user at the offending
+// line.
+type ParseError struct {
+	Line   int
+	Raw    string
+	Reason error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %q: %s", e.Line, e.Raw, e.Reason)
+}
+
+// validateIP checks ip with net.ParseIP rather than the LooksLikeIpv4/6
+// heuristics ParseLine uses, since those only need to be good enough to
+// find the IP column, not to reject malformed addresses.
+func validateIP(ip string) error {
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("%q is not a valid IP address", ip)
+	}
+	return nil
+}
+
+// validateHostname applies RFC 1123 hostname rules: labels of 1-63
+// alphanumeric-or-hyphen characters (no leading/trailing hyphen), a total
+// length of at most 253, and a TLD that isn't all-numeric.
+func validateHostname(name string) error {
+	if len(name) == 0 || len(name) > 253 {
+		return fmt.Errorf("%q must be 1-253 characters", name)
+	}
+
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if err := validateLabel(label); err != nil {
+			return fmt.Errorf("%q: %s", name, err)
+		}
+	}
+
+	tld := labels[len(labels)-1]
+	if strings.Trim(tld, "0123456789") == "" {
+		return fmt.Errorf("%q: TLD %q must not be all-numeric", name, tld)
+	}
+
+	return nil
+}
+
+func validateLabel(label string) error {
+	if len(label) == 0 || len(label) > 63 {
+		return fmt.Errorf("label %q must be 1-63 characters", label)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("label %q must not start or end with a hyphen", label)
+	}
+	for _, r := range label {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return fmt.Errorf("label %q contains invalid character %q", label, r)
+		}
+	}
+	return nil
+}